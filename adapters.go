@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/proxy/shadowsocks"
+	"github.com/xtls/xray-core/proxy/trojan"
+	"github.com/xtls/xray-core/proxy/vless"
+	"github.com/xtls/xray-core/proxy/vmess"
+)
+
+// ProtocolAdapter hides the protocol-specific account encoding and traffic
+// pattern naming behind a single interface, so synchronizeUsers can manage
+// mixed Shadowsocks/VMess/VLESS/Trojan inbounds without branching on
+// user.Protocol itself.
+type ProtocolAdapter interface {
+	// BuildAccount builds the typed account message carried by AddUserOperation.
+	BuildAccount(user UserInfo) *serial.TypedMessage
+	// InboundTag returns the tag of the inbound this adapter manages users on.
+	InboundTag() string
+	// TrafficPatterns returns the stats query patterns for uplink/downlink.
+	TrafficPatterns(email string) (uplink, downlink string)
+}
+
+// trafficPatterns is shared by every adapter: xray-core's stats service
+// always keys traffic counters as "user>>>email>>>traffic>>>direction"
+// regardless of the inbound's protocol.
+func trafficPatterns(email string) (string, string) {
+	return fmt.Sprintf("user>>>%s>>>traffic>>>uplink", email),
+		fmt.Sprintf("user>>>%s>>>traffic>>>downlink", email)
+}
+
+// ShadowsocksAdapter preserves the syncer's original behavior.
+type ShadowsocksAdapter struct {
+	InTag  string
+	Cipher shadowsocks.CipherType
+}
+
+func (a *ShadowsocksAdapter) BuildAccount(user UserInfo) *serial.TypedMessage {
+	return serial.ToTypedMessage(&shadowsocks.Account{
+		Password:   user.Password,
+		CipherType: a.Cipher,
+	})
+}
+
+func (a *ShadowsocksAdapter) InboundTag() string { return a.InTag }
+
+func (a *ShadowsocksAdapter) TrafficPatterns(email string) (string, string) {
+	return trafficPatterns(email)
+}
+
+// VMessAdapter manages VMess inbounds, identifying users by UUID.
+type VMessAdapter struct {
+	InTag    string
+	AlterID  uint32
+	Security string
+}
+
+func (a *VMessAdapter) BuildAccount(user UserInfo) *serial.TypedMessage {
+	return serial.ToTypedMessage(&vmess.Account{
+		Id:               deriveUUID(user.Password),
+		AlterId:          a.AlterID,
+		SecuritySettings: &protocol.SecurityConfig{Type: securityType(a.Security)},
+	})
+}
+
+func (a *VMessAdapter) InboundTag() string { return a.InTag }
+
+func (a *VMessAdapter) TrafficPatterns(email string) (string, string) {
+	return trafficPatterns(email)
+}
+
+// VLESSAdapter manages VLESS inbounds, identifying users by UUID and flow.
+type VLESSAdapter struct {
+	InTag string
+	Flow  string
+}
+
+func (a *VLESSAdapter) BuildAccount(user UserInfo) *serial.TypedMessage {
+	return serial.ToTypedMessage(&vless.Account{
+		Id:   deriveUUID(user.Password),
+		Flow: a.Flow,
+	})
+}
+
+func (a *VLESSAdapter) InboundTag() string { return a.InTag }
+
+func (a *VLESSAdapter) TrafficPatterns(email string) (string, string) {
+	return trafficPatterns(email)
+}
+
+// TrojanAdapter manages Trojan inbounds, identifying users by password.
+type TrojanAdapter struct {
+	InTag string
+}
+
+func (a *TrojanAdapter) BuildAccount(user UserInfo) *serial.TypedMessage {
+	return serial.ToTypedMessage(&trojan.Account{
+		Password: user.Password,
+	})
+}
+
+func (a *TrojanAdapter) InboundTag() string { return a.InTag }
+
+func (a *TrojanAdapter) TrafficPatterns(email string) (string, string) {
+	return trafficPatterns(email)
+}
+
+// deriveUUID maps seed (the per-user value already unique across the
+// account, e.g. UserInfo.Password) onto a deterministic RFC 4122 UUID
+// string. VMess and VLESS accounts are keyed by UUID, not by an arbitrary
+// password string, and this table has no dedicated UUID column, so the UUID
+// is derived instead of stored: the same seed always yields the same UUID,
+// which is what AlterInbound's add/update/remove calls need across cycles.
+func deriveUUID(seed string) string {
+	sum := md5.Sum([]byte("xray-api-mu:uuid:" + seed))
+	sum[6] = (sum[6] & 0x0f) | 0x30 // version 3
+	sum[8] = (sum[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// securityType maps the YAML-friendly security name used in sync.vmess_security
+// to the protocol.SecurityType xray-core expects for VMess accounts.
+func securityType(name string) protocol.SecurityType {
+	switch name {
+	case "aes-128-gcm":
+		return protocol.SecurityType_AES128_GCM
+	case "chacha20-poly1305":
+		return protocol.SecurityType_CHACHA20_POLY1305
+	case "none":
+		return protocol.SecurityType_NONE
+	default:
+		return protocol.SecurityType_AUTO
+	}
+}
+
+// ssCipherType maps the YAML-friendly cipher name used in sync.ss_cipher to
+// the shadowsocks.CipherType xray-core expects for Shadowsocks accounts.
+func ssCipherType(name string) shadowsocks.CipherType {
+	switch name {
+	case "", "aes-128-gcm":
+		return shadowsocks.CipherType_AES_128_GCM
+	case "aes-256-gcm":
+		return shadowsocks.CipherType_AES_256_GCM
+	case "chacha20-poly1305":
+		return shadowsocks.CipherType_CHACHA20_POLY1305
+	default:
+		return shadowsocks.CipherType_AES_128_GCM
+	}
+}
+
+// adapterForProtocol selects the ProtocolAdapter to use for a user based on
+// the `protocol` column read from the database, falling back to Shadowsocks
+// for rows written before that column existed. Each protocol manages its own
+// inbound, so it's routed through its own configured tag rather than sharing
+// sync.in_tag — xray-core rejects AlterInbound calls whose account type
+// doesn't match the inbound's configured protocol.
+func adapterForProtocol(name string, cfg *SyncConfig) (ProtocolAdapter, error) {
+	switch name {
+	case "", "shadowsocks":
+		return &ShadowsocksAdapter{InTag: cfg.InTag, Cipher: ssCipherType(cfg.SSCipher)}, nil
+	case "vmess":
+		if cfg.VMessTag == "" {
+			return nil, fmt.Errorf("adapters: sync.vmess_in_tag is required to manage vmess users")
+		}
+		return &VMessAdapter{InTag: cfg.VMessTag, AlterID: 0, Security: cfg.VMessSecurity}, nil
+	case "vless":
+		if cfg.VLESSTag == "" {
+			return nil, fmt.Errorf("adapters: sync.vless_in_tag is required to manage vless users")
+		}
+		return &VLESSAdapter{InTag: cfg.VLESSTag, Flow: ""}, nil
+	case "trojan":
+		if cfg.TrojanTag == "" {
+			return nil, fmt.Errorf("adapters: sync.trojan_in_tag is required to manage trojan users")
+		}
+		return &TrojanAdapter{InTag: cfg.TrojanTag}, nil
+	default:
+		return nil, fmt.Errorf("adapters: unknown protocol %q", name)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/common/uuid"
+	"github.com/xtls/xray-core/proxy/shadowsocks"
+	"github.com/xtls/xray-core/proxy/trojan"
+	"github.com/xtls/xray-core/proxy/vless"
+	"github.com/xtls/xray-core/proxy/vmess"
+)
+
+func TestAdapterForProtocolShadowsocks(t *testing.T) {
+	cfg := &SyncConfig{InTag: "ss-in", SSCipher: "chacha20-poly1305"}
+
+	adapter, err := adapterForProtocol("", cfg)
+	if err != nil {
+		t.Fatalf("adapterForProtocol(\"\") = %v, want nil error", err)
+	}
+	if adapter.InboundTag() != "ss-in" {
+		t.Fatalf("InboundTag() = %q, want %q", adapter.InboundTag(), "ss-in")
+	}
+
+	adapter, err = adapterForProtocol("shadowsocks", cfg)
+	if err != nil {
+		t.Fatalf("adapterForProtocol(\"shadowsocks\") = %v, want nil error", err)
+	}
+	if adapter.InboundTag() != "ss-in" {
+		t.Fatalf("InboundTag() = %q, want %q", adapter.InboundTag(), "ss-in")
+	}
+}
+
+func TestAdapterForProtocolRequiresTag(t *testing.T) {
+	cfg := &SyncConfig{InTag: "ss-in"}
+
+	for _, proto := range []string{"vmess", "vless", "trojan"} {
+		if _, err := adapterForProtocol(proto, cfg); err == nil {
+			t.Errorf("adapterForProtocol(%q) = nil error, want error when its tag is unset", proto)
+		}
+	}
+}
+
+func TestAdapterForProtocolPerProtocolTags(t *testing.T) {
+	cfg := &SyncConfig{
+		InTag:     "ss-in",
+		VMessTag:  "vmess-in",
+		VLESSTag:  "vless-in",
+		TrojanTag: "trojan-in",
+	}
+
+	cases := map[string]string{
+		"vmess":  "vmess-in",
+		"vless":  "vless-in",
+		"trojan": "trojan-in",
+	}
+	for proto, wantTag := range cases {
+		adapter, err := adapterForProtocol(proto, cfg)
+		if err != nil {
+			t.Fatalf("adapterForProtocol(%q) = %v, want nil error", proto, err)
+		}
+		if got := adapter.InboundTag(); got != wantTag {
+			t.Errorf("adapterForProtocol(%q).InboundTag() = %q, want %q", proto, got, wantTag)
+		}
+	}
+}
+
+func TestAdapterForProtocolUnknown(t *testing.T) {
+	cfg := &SyncConfig{InTag: "ss-in"}
+	if _, err := adapterForProtocol("wireguard", cfg); err == nil {
+		t.Fatal("adapterForProtocol(\"wireguard\") = nil error, want error for unknown protocol")
+	}
+}
+
+func TestSSCipherType(t *testing.T) {
+	defaultCipher := ssCipherType("aes-128-gcm")
+
+	for _, name := range []string{"", "aes-128-gcm", "unknown-cipher"} {
+		if got := ssCipherType(name); got != defaultCipher {
+			t.Errorf("ssCipherType(%q) = %v, want default cipher %v", name, got, defaultCipher)
+		}
+	}
+
+	if ssCipherType("aes-256-gcm") == defaultCipher {
+		t.Error("ssCipherType(\"aes-256-gcm\") should differ from the aes-128-gcm default")
+	}
+	if ssCipherType("chacha20-poly1305") == defaultCipher {
+		t.Error("ssCipherType(\"chacha20-poly1305\") should differ from the aes-128-gcm default")
+	}
+}
+
+func unpackAccount(t *testing.T, msg *serial.TypedMessage) interface{} {
+	t.Helper()
+	account, err := serial.GetInstance(msg)
+	if err != nil {
+		t.Fatalf("serial.GetInstance() = %v, want nil error", err)
+	}
+	return account
+}
+
+func TestShadowsocksAdapterBuildAccount(t *testing.T) {
+	a := &ShadowsocksAdapter{InTag: "ss-in", Cipher: shadowsocks.CipherType_AES_256_GCM}
+	account, ok := unpackAccount(t, a.BuildAccount(UserInfo{Password: "1234secret"})).(*shadowsocks.Account)
+	if !ok {
+		t.Fatal("BuildAccount() did not unpack to *shadowsocks.Account")
+	}
+	if account.Password != "1234secret" {
+		t.Errorf("Password = %q, want %q", account.Password, "1234secret")
+	}
+	if account.CipherType != shadowsocks.CipherType_AES_256_GCM {
+		t.Errorf("CipherType = %v, want %v", account.CipherType, shadowsocks.CipherType_AES_256_GCM)
+	}
+}
+
+func TestVMessAdapterBuildAccountUsesUUID(t *testing.T) {
+	a := &VMessAdapter{InTag: "vmess-in", AlterID: 0, Security: "aes-128-gcm"}
+	account, ok := unpackAccount(t, a.BuildAccount(UserInfo{Password: "1234secret"})).(*vmess.Account)
+	if !ok {
+		t.Fatal("BuildAccount() did not unpack to *vmess.Account")
+	}
+	if _, err := uuid.ParseString(account.Id); err != nil {
+		t.Errorf("Id = %q is not a valid UUID: %v", account.Id, err)
+	}
+	if want := securityType("aes-128-gcm"); account.SecuritySettings.Type != want {
+		t.Errorf("SecuritySettings.Type = %v, want %v", account.SecuritySettings.Type, want)
+	}
+}
+
+func TestVLESSAdapterBuildAccountUsesUUID(t *testing.T) {
+	a := &VLESSAdapter{InTag: "vless-in", Flow: "xtls-rprx-vision"}
+	account, ok := unpackAccount(t, a.BuildAccount(UserInfo{Password: "1234secret"})).(*vless.Account)
+	if !ok {
+		t.Fatal("BuildAccount() did not unpack to *vless.Account")
+	}
+	if _, err := uuid.ParseString(account.Id); err != nil {
+		t.Errorf("Id = %q is not a valid UUID: %v", account.Id, err)
+	}
+	if account.Flow != "xtls-rprx-vision" {
+		t.Errorf("Flow = %q, want %q", account.Flow, "xtls-rprx-vision")
+	}
+}
+
+func TestDeriveUUIDDeterministic(t *testing.T) {
+	if deriveUUID("1234secret") != deriveUUID("1234secret") {
+		t.Error("deriveUUID should be deterministic for the same seed")
+	}
+	if deriveUUID("1234secret") == deriveUUID("5678other") {
+		t.Error("deriveUUID should differ for different seeds")
+	}
+}
+
+func TestTrojanAdapterBuildAccount(t *testing.T) {
+	a := &TrojanAdapter{InTag: "trojan-in"}
+	account, ok := unpackAccount(t, a.BuildAccount(UserInfo{Password: "1234secret"})).(*trojan.Account)
+	if !ok {
+		t.Fatal("BuildAccount() did not unpack to *trojan.Account")
+	}
+	if account.Password != "1234secret" {
+		t.Errorf("Password = %q, want %q", account.Password, "1234secret")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maskedUser is the GET /users representation: the password is masked so
+// the admin API can't be used to exfiltrate live credentials.
+type maskedUser struct {
+	Email    string `json:"email"`
+	Protocol string `json:"protocol"`
+	Password string `json:"password"`
+}
+
+func maskPassword(p string) string {
+	if len(p) <= 4 {
+		return "****"
+	}
+	return p[:2] + strings.Repeat("*", len(p)-4) + p[len(p)-2:]
+}
+
+// AdminServer exposes the syncer's health, user list and metrics over HTTP,
+// and lets operators trigger an out-of-cycle sync or force-remove a user.
+type AdminServer struct {
+	syncer *Syncer
+}
+
+// NewAdminServer builds the admin HTTP handler for syncer.
+func NewAdminServer(syncer *Syncer) *AdminServer {
+	return &AdminServer{syncer: syncer}
+}
+
+// Handler returns the http.Handler to listen on cfg.ListenAPI.
+func (a *AdminServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", a.handleHealthz)
+	mux.HandleFunc("/users", a.handleUsers)
+	mux.HandleFunc("/sync", a.handleSync)
+	mux.HandleFunc("/metrics", a.handleMetrics)
+	mux.HandleFunc("/users/", a.handleUserDelete)
+	return mux
+}
+
+func (a *AdminServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	lastAttemptAt, lastErr := a.syncer.metrics.LastSync()
+	lastSuccessAt := a.syncer.metrics.LastSuccess()
+	status := "ok"
+	if lastErr != nil {
+		status = "degraded"
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":          status,
+		"last_sync_at":    lastSuccessAt.Format(time.RFC3339),
+		"last_attempt_at": lastAttemptAt.Format(time.RFC3339),
+		"last_sync_error": errString(lastErr),
+	})
+}
+
+func (a *AdminServer) handleUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	users := a.syncer.Users()
+	masked := make([]maskedUser, 0, len(users))
+	for _, u := range users {
+		masked = append(masked, maskedUser{
+			Email:    u.Email,
+			Protocol: u.Protocol,
+			Password: maskPassword(u.Password),
+		})
+	}
+	writeJSON(w, http.StatusOK, masked)
+}
+
+func (a *AdminServer) handleSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	if err := a.syncer.RunCycle(ctx); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "synced"})
+}
+
+func (a *AdminServer) handleUserDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	email := strings.TrimPrefix(r.URL.Path, "/users/")
+	if email == "" {
+		http.Error(w, "email is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	if err := a.syncer.ForceRemoveUser(ctx, email); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "removed"})
+}
+
+func (a *AdminServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, a.syncer.metrics.Render())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestMaskPassword(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"", "****"},
+		{"ab", "****"},
+		{"abcd", "****"},
+		{"abcde", "ab*de"},
+		{"supersecret", "su*******et"},
+	}
+
+	for _, tc := range cases {
+		if got := maskPassword(tc.in); got != tc.want {
+			t.Errorf("maskPassword(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
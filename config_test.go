@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func validConfig() *Config {
+	return &Config{
+		MySQL:   MySQLConfig{Addr: "127.0.0.1:3306", User: "root", DB: "xray"},
+		XrayAPI: XrayAPIConfig{Address: "127.0.0.1", Port: 10085},
+		Sync:    SyncConfig{Interval: 1, InTag: "ss-in"},
+	}
+}
+
+func TestConfigValidateOK(t *testing.T) {
+	cfg := validConfig()
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("validate() = %v, want nil", err)
+	}
+}
+
+func TestConfigValidateMissingFields(t *testing.T) {
+	cases := []struct {
+		name   string
+		mutate func(*Config)
+	}{
+		{"mysql.addr", func(c *Config) { c.MySQL.Addr = "" }},
+		{"mysql.user", func(c *Config) { c.MySQL.User = "" }},
+		{"mysql.db", func(c *Config) { c.MySQL.DB = "" }},
+		{"xray_api.address", func(c *Config) { c.XrayAPI.Address = "" }},
+		{"xray_api.port", func(c *Config) { c.XrayAPI.Port = 0 }},
+		{"sync.interval", func(c *Config) { c.Sync.Interval = 0 }},
+		{"sync.in_tag", func(c *Config) { c.Sync.InTag = "" }},
+		{"state.dsn", func(c *Config) { c.State.Driver = "redis"; c.State.DSN = "" }},
+		{"logs.level", func(c *Config) { c.Logs.Level = "verbose" }},
+		{"logs.file", func(c *Config) { c.Logs.SaveFile = true; c.Logs.File = "" }},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := validConfig()
+			tc.mutate(cfg)
+			if err := cfg.validate(); err == nil {
+				t.Fatalf("validate() = nil, want error for missing %s", tc.name)
+			}
+		})
+	}
+}
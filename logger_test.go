@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	cases := map[string]LogLevel{
+		"":        LevelInfo,
+		"info":    LevelInfo,
+		"debug":   LevelDebug,
+		"warn":    LevelWarn,
+		"warning": LevelWarn,
+		"error":   LevelError,
+		"bogus":   LevelInfo,
+	}
+	for in, want := range cases {
+		if got := parseLogLevel(in); got != want {
+			t.Errorf("parseLogLevel(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
+
+func TestNewLoggerSaveFileWritesToDisk(t *testing.T) {
+	dir := t.TempDir()
+	logger, err := NewLogger(&LogsConfig{Dir: dir, File: "sync.log", Level: "info", SaveFile: true})
+	if err != nil {
+		t.Fatalf("NewLogger() = %v, want nil error", err)
+	}
+	defer logger.Close()
+
+	logger.Infof("hello %s\n", "world")
+
+	raw, err := os.ReadFile(filepath.Join(dir, "sync.log"))
+	if err != nil {
+		t.Fatalf("read log file: %v", err)
+	}
+	if len(raw) == 0 {
+		t.Error("log file is empty, want the logged line to have been written")
+	}
+}
+
+func TestNewLoggerWithoutSaveFileStaysStdoutOnly(t *testing.T) {
+	logger, err := NewLogger(&LogsConfig{Level: "info"})
+	if err != nil {
+		t.Fatalf("NewLogger() = %v, want nil error", err)
+	}
+	defer logger.Close()
+
+	if logger.file != nil {
+		t.Error("file should be nil when logs.savefile is unset")
+	}
+}
@@ -2,31 +2,31 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"sync"
 	"time"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/xtls/xray-core/app/proxyman/command"
 	statsService "github.com/xtls/xray-core/app/stats/command"
 	"github.com/xtls/xray-core/common/protocol"
 	"github.com/xtls/xray-core/common/serial"
-	"github.com/xtls/xray-core/proxy/shadowsocks"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
-type BaseConfig struct {
-	APIAddress string
-	APIPort    uint16
-}
-
 type UserInfo struct {
 	Level    uint32
 	InTag    string
 	Email    string
 	Password string
+	Protocol string
 }
 
 type TrafficData struct {
@@ -40,8 +40,13 @@ type XrayController struct {
 	CmdConn     *grpc.ClientConn
 }
 
-func (xrayCtl *XrayController) Init(cfg *BaseConfig) (err error) {
-	xrayCtl.CmdConn, err = grpc.Dial(fmt.Sprintf("%s:%d", cfg.APIAddress, cfg.APIPort), grpc.WithInsecure())
+func (xrayCtl *XrayController) Init(cfg *XrayAPIConfig) (err error) {
+	dialOpt := grpc.WithInsecure()
+	if cfg.TLS {
+		dialOpt = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))
+	}
+
+	xrayCtl.CmdConn, err = grpc.Dial(fmt.Sprintf("%s:%d", cfg.Address, cfg.Port), dialOpt)
 	if err != nil {
 		return err
 	}
@@ -52,26 +57,23 @@ func (xrayCtl *XrayController) Init(cfg *BaseConfig) (err error) {
 	return
 }
 
-func addSSUser(client command.HandlerServiceClient, user *UserInfo) error {
-	_, err := client.AlterInbound(context.Background(), &command.AlterInboundRequest{
-		Tag: user.InTag,
+func addUser(ctx context.Context, client command.HandlerServiceClient, adapter ProtocolAdapter, user *UserInfo) error {
+	_, err := client.AlterInbound(ctx, &command.AlterInboundRequest{
+		Tag: adapter.InboundTag(),
 		Operation: serial.ToTypedMessage(&command.AddUserOperation{
 			User: &protocol.User{
-				Level: user.Level,
-				Email: user.Email,
-				Account: serial.ToTypedMessage(&shadowsocks.Account{
-					Password:   user.Password,
-					CipherType: shadowsocks.CipherType_AES_128_GCM,
-				}),
+				Level:   user.Level,
+				Email:   user.Email,
+				Account: adapter.BuildAccount(*user),
 			},
 		}),
 	})
 	return err
 }
 
-func removeSSUser(client command.HandlerServiceClient, email string, inTag string) error {
-	_, err := client.AlterInbound(context.Background(), &command.AlterInboundRequest{
-		Tag: inTag,
+func removeUser(ctx context.Context, client command.HandlerServiceClient, adapter ProtocolAdapter, email string) error {
+	_, err := client.AlterInbound(ctx, &command.AlterInboundRequest{
+		Tag: adapter.InboundTag(),
 		Operation: serial.ToTypedMessage(&command.RemoveUserOperation{
 			Email: email,
 		}),
@@ -79,9 +81,9 @@ func removeSSUser(client command.HandlerServiceClient, email string, inTag strin
 	return err
 }
 
-func queryTraffic(c statsService.StatsServiceClient, ptn string, reset bool) (int64, error) {
+func queryTraffic(ctx context.Context, c statsService.StatsServiceClient, ptn string, reset bool) (int64, error) {
 	traffic := int64(-1)
-	resp, err := c.QueryStats(context.Background(), &statsService.QueryStatsRequest{
+	resp, err := c.QueryStats(ctx, &statsService.QueryStatsRequest{
 		Pattern: ptn,
 		Reset_:  reset,
 	})
@@ -95,8 +97,8 @@ func queryTraffic(c statsService.StatsServiceClient, ptn string, reset bool) (in
 	return traffic, nil
 }
 
-func getUsersFromDB(db *sql.DB) ([]UserInfo, error) {
-	rows, err := db.Query("SELECT port, passwd FROM user WHERE enable = 1")
+func getUsersFromDB(db *sql.DB, syncCfg *SyncConfig) ([]UserInfo, error) {
+	rows, err := db.Query("SELECT port, passwd, protocol FROM user WHERE enable = 1")
 	if err != nil {
 		return nil, err
 	}
@@ -107,21 +109,23 @@ func getUsersFromDB(db *sql.DB) ([]UserInfo, error) {
 		var user UserInfo
 		var port int
 		var passwd string
-		if err := rows.Scan(&port, &passwd); err != nil {
+		var proto string
+		if err := rows.Scan(&port, &passwd, &proto); err != nil {
 			return nil, err
 		}
 		user.Email = fmt.Sprintf("%d", port)
 		user.Password = fmt.Sprintf("%d%s", port, passwd)
-		user.InTag = "ssapi"
-		user.Level = 0
+		user.InTag = syncCfg.InTag
+		user.Level = syncCfg.Level
+		user.Protocol = proto
 		users = append(users, user)
 	}
 
 	return users, nil
 }
 
-func getCurrentSSUsers() ([]UserInfo, error) {
-	file, err := ioutil.ReadFile("current_users.json")
+func getCurrentSSUsers(path string) ([]UserInfo, error) {
+	file, err := ioutil.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return []UserInfo{}, nil
@@ -138,13 +142,13 @@ func getCurrentSSUsers() ([]UserInfo, error) {
 	return users, nil
 }
 
-func saveCurrentSSUsers(users []UserInfo) error {
+func saveCurrentSSUsers(path string, users []UserInfo) error {
 	file, err := json.MarshalIndent(users, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	err = ioutil.WriteFile("current_users.json", file, 0644)
+	err = ioutil.WriteFile(path, file, 0644)
 	if err != nil {
 		return err
 	}
@@ -152,15 +156,69 @@ func saveCurrentSSUsers(users []UserInfo) error {
 	return nil
 }
 
-func updateTraffic(db *sql.DB, user UserInfo, traffic TrafficData) error {
-	if traffic.Download > 100 || traffic.Upload > 100 {
-		_, err := db.Exec("UPDATE user SET d = d + ?, u = u + ? WHERE port = ?", traffic.Download, traffic.Upload, user.Email)
-		return err
+// syncOneUser adds, updates or leaves a single user alone and reports its
+// traffic, returning the handled UserInfo (possibly absent on failure) and
+// whether it should remain in the in-memory current-user set.
+func syncOneUser(ctx context.Context, client command.HandlerServiceClient, statsClient statsService.StatsServiceClient, trafficBuf *TrafficBuffer, metrics *Metrics, syncCfg *SyncConfig, user UserInfo, currentUser UserInfo, exists bool) (UserInfo, bool, error) {
+	callCtx, cancel := callTimeout(ctx, callTimeoutFor(syncCfg))
+	defer cancel()
+
+	adapter, err := adapterForProtocol(user.Protocol, syncCfg)
+	if err != nil {
+		return UserInfo{}, false, err
 	}
-	return nil
+
+	if !exists {
+		defaultLogger.Infof("Adding user: %s\n", user.Email)
+		err := addUser(callCtx, client, adapter, &user)
+		metrics.RecordUserAdd(err == nil)
+		if err != nil {
+			return UserInfo{}, false, fmt.Errorf("add user: %w", err)
+		}
+	} else if currentUser.Password != user.Password || currentUser.Protocol != user.Protocol {
+		defaultLogger.Infof("Updating user password: %s\n", user.Email)
+		currentAdapter, err := adapterForProtocol(currentUser.Protocol, syncCfg)
+		if err != nil {
+			currentAdapter = adapter
+		}
+		if err := removeUser(callCtx, client, currentAdapter, user.Email); err != nil {
+			return UserInfo{}, false, fmt.Errorf("remove user for update: %w", err)
+		}
+		err = addUser(callCtx, client, adapter, &user)
+		metrics.RecordUserAdd(err == nil)
+		if err != nil {
+			return UserInfo{}, false, fmt.Errorf("add user after update: %w", err)
+		}
+	}
+
+	// 查询并上报流量
+	uplinkPattern, downlinkPattern := adapter.TrafficPatterns(user.Email)
+	uplink, err := queryTraffic(callCtx, statsClient, uplinkPattern, true)
+	if err != nil {
+		defaultLogger.Errorf("Failed to query uplink traffic for user: %s, error: %v\n", user.Email, err)
+	}
+	downlink, err := queryTraffic(callCtx, statsClient, downlinkPattern, true)
+	if err != nil {
+		defaultLogger.Errorf("Failed to query downlink traffic for user: %s, error: %v\n", user.Email, err)
+	}
+	// queryTraffic 在查询失败或尚无计数时返回 -1，按 0 计
+	if uplink < 0 {
+		uplink = 0
+	}
+	if downlink < 0 {
+		downlink = 0
+	}
+	metrics.RecordTraffic(user.Email, uplink, downlink)
+
+	// 计数器在查询时已被重置，任何非零流量都要进入缓冲，由缓冲跨周期累加直到写库成功
+	if uplink > 0 || downlink > 0 {
+		trafficBuf.Add(user.Email, TrafficData{Download: downlink, Upload: uplink})
+	}
+
+	return user, true, nil
 }
 
-func synchronizeUsers(client command.HandlerServiceClient, statsClient statsService.StatsServiceClient, db *sql.DB, dbUsers, currentUsers []UserInfo) error {
+func synchronizeUsers(ctx context.Context, client command.HandlerServiceClient, statsClient statsService.StatsServiceClient, db *sql.DB, store StateStore, trafficBuf *TrafficBuffer, metrics *Metrics, dbUsers, currentUsers []UserInfo, syncCfg *SyncConfig) error {
 	dbUserMap := make(map[string]UserInfo)
 	for _, user := range dbUsers {
 		dbUserMap[user.Email] = user
@@ -171,126 +229,185 @@ func synchronizeUsers(client command.HandlerServiceClient, statsClient statsServ
 		currentUserMap[user.Email] = user
 	}
 
-	// Add or update users from the database
-	for email, user := range dbUserMap {
-		currentUser, exists := currentUserMap[email]
-		if !exists {
-			fmt.Printf("[%s] Adding user: %s\n", time.Now().Format(time.RFC3339), email)
-			if err := addSSUser(client, &user); err != nil {
-				fmt.Printf("[%s] Failed to add user: %s, error: %v\n", time.Now().Format(time.RFC3339), email, err)
-			} else {
-				currentUserMap[email] = user
-			}
-		} else if currentUser.Password != user.Password {
-			fmt.Printf("[%s] Updating user password: %s\n", time.Now().Format(time.RFC3339), email)
-			if err := removeSSUser(client, email, "ssapi"); err != nil {
-				fmt.Printf("[%s] Failed to remove user for update: %s, error: %v\n", time.Now().Format(time.RFC3339), email, err)
-			} else {
-				if err := addSSUser(client, &user); err != nil {
-					fmt.Printf("[%s] Failed to add user after update: %s, error: %v\n", time.Now().Format(time.RFC3339), email, err)
-				} else {
-					currentUserMap[email] = user
+	collector := &errCollector{}
+	resultCh := make(chan UserInfo, len(dbUserMap))
+	jobCh := make(chan UserInfo)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workerCount(syncCfg); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for user := range jobCh {
+				currentUser, exists := currentUserMap[user.Email]
+				updated, keep, err := syncOneUser(ctx, client, statsClient, trafficBuf, metrics, syncCfg, user, currentUser, exists)
+				if err != nil {
+					collector.add(user.Email, err)
+					continue
+				}
+				if keep {
+					resultCh <- updated
 				}
 			}
-		}
+		}()
+	}
 
-		// 查询并上报流量
-		uplinkPattern := fmt.Sprintf("user>>>%s>>>traffic>>>uplink", email)
-		downlinkPattern := fmt.Sprintf("user>>>%s>>>traffic>>>downlink", email)
-		uplink, err := queryTraffic(statsClient, uplinkPattern, true)
-		if err != nil {
-			fmt.Printf("[%s] Failed to query uplink traffic for user: %s, error: %v\n", time.Now().Format(time.RFC3339), email, err)
-		}
-		downlink, err := queryTraffic(statsClient, downlinkPattern, true)
-		if err != nil {
-			fmt.Printf("[%s] Failed to query downlink traffic for user: %s, error: %v\n", time.Now().Format(time.RFC3339), email, err)
+	for _, user := range dbUserMap {
+		select {
+		case jobCh <- user:
+		case <-ctx.Done():
 		}
+	}
+	close(jobCh)
+	wg.Wait()
+	close(resultCh)
 
-		traffic := TrafficData{
-			Download: downlink,
-			Upload:   uplink,
-		}
-		if err := updateTraffic(db, user, traffic); err != nil {
-			fmt.Printf("[%s] Failed to update traffic for user: %s, error: %v\n", time.Now().Format(time.RFC3339), email, err)
-		}
+	survivingUserMap := make(map[string]UserInfo)
+	for user := range resultCh {
+		survivingUserMap[user.Email] = user
 	}
 
-	// Remove users not in the database
-	for email := range currentUserMap {
-		if _, exists := dbUserMap[email]; !exists {
-			fmt.Printf("[%s] Removing user: %s\n", time.Now().Format(time.RFC3339), email)
-			if err := removeSSUser(client, email, "ssapi"); err != nil {
-				fmt.Printf("[%s] Failed to remove user: %s, error: %v\n", time.Now().Format(time.RFC3339), email, err)
-			} else {
-				delete(currentUserMap, email)
+	// Remove users that were provisioned before but no longer exist in the
+	// database, through a second worker pool of the same bounded size as the
+	// add/update pool.
+	removeCh := make(chan UserInfo)
+	var removeWg sync.WaitGroup
+	for i := 0; i < workerCount(syncCfg); i++ {
+		removeWg.Add(1)
+		go func() {
+			defer removeWg.Done()
+			for user := range removeCh {
+				callCtx, cancel := callTimeout(ctx, callTimeoutFor(syncCfg))
+
+				defaultLogger.Infof("Removing user: %s\n", user.Email)
+				adapter, err := adapterForProtocol(user.Protocol, syncCfg)
+				if err != nil {
+					collector.add(user.Email, err)
+					cancel()
+					continue
+				}
+				err = removeUser(callCtx, client, adapter, user.Email)
+				metrics.RecordUserRemove(err == nil)
+				if err != nil {
+					collector.add(user.Email, fmt.Errorf("remove user: %w", err))
+				}
+				cancel()
 			}
+		}()
+	}
+
+	for email, user := range currentUserMap {
+		if _, inDB := dbUserMap[email]; inDB {
+			continue
+		}
+		select {
+		case removeCh <- user:
+		case <-ctx.Done():
 		}
 	}
+	close(removeCh)
+	removeWg.Wait()
 
 	var updatedUsers []UserInfo
-	for _, user := range currentUserMap {
+	for _, user := range survivingUserMap {
 		updatedUsers = append(updatedUsers, user)
 	}
 
-	return saveCurrentSSUsers(updatedUsers)
+	if err := store.Save(updatedUsers); err != nil {
+		collector.add("*", fmt.Errorf("save state: %w", err))
+	}
+
+	if err := trafficBuf.Flush(db); err != nil {
+		collector.add("*", err)
+	}
+
+	return collector.asError()
 }
 
 func main() {
-	// 删除current_users.json文件
-	if err := os.Remove("current_users.json"); err != nil && !os.IsNotExist(err) {
-		fmt.Printf("[%s] 删除 current_users.json 失败: %v\n", time.Now().Format(time.RFC3339), err)
+	configPath := flag.String("c", "config.yaml", "path to the YAML config file")
+	flag.Parse()
+
+	configMgr, err := NewConfigManager(*configPath)
+	if err != nil {
+		defaultLogger.Errorf("加载配置失败: %v\n", err)
 		return
 	}
+	cfg := configMgr.Current()
 
-	// 配置数据库连接
-	dsn := "DBUSER:DBPASSWD@tcp(dbserver.com)/DBNAME"
-	db, err := sql.Open("mysql", dsn)
+	logger, err := NewLogger(&cfg.Logs)
 	if err != nil {
-		fmt.Printf("[%s] 数据库连接失败: %v\n", time.Now().Format(time.RFC3339), err)
+		defaultLogger.Errorf("初始化日志失败: %v\n", err)
 		return
 	}
-	defer db.Close()
+	defaultLogger = logger
+	defer defaultLogger.Close()
 
-	// 配置Xray API连接
-	cfg := &BaseConfig{
-		APIAddress: "127.0.0.1",
-		APIPort:    9085,
+	store, err := NewStateStore(&cfg.State, cfg.State.NodeID)
+	if err != nil {
+		defaultLogger.Errorf("初始化状态存储失败: %v\n", err)
+		return
+	}
+
+	// 配置数据库连接；凭据的热重载由 Syncer.reloadDBIfChanged 负责
+	db, err := openMySQL(&cfg.MySQL)
+	if err != nil {
+		defaultLogger.Errorf("数据库连接失败: %v\n", err)
+		return
 	}
 
 	xrayCtl := &XrayController{}
-	err = xrayCtl.Init(cfg)
+	err = xrayCtl.Init(&cfg.XrayAPI)
 	if err != nil {
-		fmt.Printf("[%s] 初始化 XrayController 失败: %v\n", time.Now().Format(time.RFC3339), err)
+		defaultLogger.Errorf("初始化 XrayController 失败: %v\n", err)
 		return
 	}
 
-	// 创建一个每30秒触发一次的ticker
-	ticker := time.NewTicker(60 * time.Second)
+	metrics := NewMetrics()
+	trafficBuf := NewTrafficBuffer(&cfg.Traffic, metrics)
+	syncer := NewSyncer(db, &cfg.MySQL, xrayCtl, store, trafficBuf, configMgr, metrics)
+	defer syncer.Close()
+
+	if cfg.ListenAPI != "" {
+		admin := NewAdminServer(syncer)
+		go func() {
+			defaultLogger.Infof("管理/指标 API 监听于 %s\n", cfg.ListenAPI)
+			if err := http.ListenAndServe(cfg.ListenAPI, admin.Handler()); err != nil {
+				defaultLogger.Errorf("管理 API 退出: %v\n", err)
+			}
+		}()
+	}
+
+	// rootCtx is cancelled on SIGTERM so an in-flight cycle aborts instead
+	// of blocking process shutdown.
+	rootCtx, stop := rootContext()
+	defer stop()
+
+	// 同步周期可通过 SIGHUP 热重载调整，这里每轮循环都重新读取一次
+	ticker := time.NewTicker(cfg.Sync.Interval)
 	defer ticker.Stop()
 
 	for {
-		// 获取数据库中的用户
-		dbUsers, err := getUsersFromDB(db)
-		if err != nil {
-			fmt.Printf("[%s] 获取数据库用户失败: %v\n", time.Now().Format(time.RFC3339), err)
-			continue
-		}
-
-		// 获取当前Xray中的用户
-		currentUsers, err := getCurrentSSUsers()
-		if err != nil {
-			fmt.Printf("[%s] 获取当前Xray用户失败: %v\n", time.Now().Format(time.RFC3339), err)
-			continue
+		cfg = configMgr.Current()
+		if rootCtx.Err() != nil {
+			return
 		}
 
-		// 同步用户并上报流量
-		err = synchronizeUsers(xrayCtl.HsClient, xrayCtl.StatsClient, db, dbUsers, currentUsers)
+		// 一个周期的所有RPC都不能跑过该周期自身的时长
+		cycleCtx, cancelCycle := context.WithTimeout(rootCtx, cfg.Sync.Interval)
+		err = syncer.RunCycle(cycleCtx)
+		cancelCycle()
 		if err != nil {
-			fmt.Printf("[%s] 同步用户失败: %v\n", time.Now().Format(time.RFC3339), err)
+			defaultLogger.Errorf("同步用户失败: %v\n", err)
 		} else {
-			fmt.Printf("[%s] 用户同步成功\n", time.Now().Format(time.RFC3339))
+			defaultLogger.Infof("用户同步成功\n")
 		}
 
-		<-ticker.C
+		ticker.Reset(cfg.Sync.Interval)
+		select {
+		case <-ticker.C:
+		case <-rootCtx.Done():
+			return
+		}
 	}
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics accumulates the counters and gauges exposed by GET /metrics, and
+// backs the liveness info returned by GET /healthz.
+type Metrics struct {
+	mu sync.Mutex
+
+	syncCycles       int64
+	userAddOK        int64
+	userAddFail      int64
+	userRemoveOK     int64
+	userRemoveFail   int64
+	trafficUpload    map[string]int64
+	trafficDownload  map[string]int64
+	currentUserCount int
+	lastCycleDur     time.Duration
+	lastAttemptAt    time.Time
+	lastSyncErr      error
+	lastSuccessAt    time.Time
+	bufferedTraffic  int64
+}
+
+// NewMetrics returns an empty Metrics ready to record a syncer's lifetime.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		trafficUpload:   make(map[string]int64),
+		trafficDownload: make(map[string]int64),
+	}
+}
+
+func (m *Metrics) RecordCycle(dur time.Duration, userCount int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.syncCycles++
+	m.lastCycleDur = dur
+	m.currentUserCount = userCount
+	m.lastAttemptAt = time.Now()
+	m.lastSyncErr = err
+	if err == nil {
+		m.lastSuccessAt = m.lastAttemptAt
+	}
+}
+
+func (m *Metrics) RecordUserAdd(ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ok {
+		m.userAddOK++
+	} else {
+		m.userAddFail++
+	}
+}
+
+func (m *Metrics) RecordUserRemove(ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ok {
+		m.userRemoveOK++
+	} else {
+		m.userRemoveFail++
+	}
+}
+
+func (m *Metrics) RecordTraffic(email string, upload, download int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.trafficUpload[email] += upload
+	m.trafficDownload[email] += download
+}
+
+// SetBufferedTrafficBytes reports how many traffic bytes are sitting in the
+// TrafficBuffer waiting to be flushed to MySQL.
+func (m *Metrics) SetBufferedTrafficBytes(bytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bufferedTraffic = bytes
+}
+
+// LastSync reports the timestamp of the most recent sync attempt and its
+// outcome, used by GET /healthz.
+func (m *Metrics) LastSync() (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastAttemptAt, m.lastSyncErr
+}
+
+// LastSuccess reports the timestamp of the most recently *successful* sync
+// cycle, so a run of failing cycles can't hide behind the healthy-looking
+// attempt timestamp LastSync alone would report.
+func (m *Metrics) LastSuccess() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastSuccessAt
+}
+
+// Render formats every metric in Prometheus text exposition format.
+func (m *Metrics) Render() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP xrayapi_sync_cycles_total Total number of sync cycles run.\n")
+	fmt.Fprintf(&b, "# TYPE xrayapi_sync_cycles_total counter\n")
+	fmt.Fprintf(&b, "xrayapi_sync_cycles_total %d\n", m.syncCycles)
+
+	fmt.Fprintf(&b, "# HELP xrayapi_user_add_total Total number of user add attempts, by result.\n")
+	fmt.Fprintf(&b, "# TYPE xrayapi_user_add_total counter\n")
+	fmt.Fprintf(&b, "xrayapi_user_add_total{result=\"ok\"} %d\n", m.userAddOK)
+	fmt.Fprintf(&b, "xrayapi_user_add_total{result=\"error\"} %d\n", m.userAddFail)
+
+	fmt.Fprintf(&b, "# HELP xrayapi_user_remove_total Total number of user remove attempts, by result.\n")
+	fmt.Fprintf(&b, "# TYPE xrayapi_user_remove_total counter\n")
+	fmt.Fprintf(&b, "xrayapi_user_remove_total{result=\"ok\"} %d\n", m.userRemoveOK)
+	fmt.Fprintf(&b, "xrayapi_user_remove_total{result=\"error\"} %d\n", m.userRemoveFail)
+
+	fmt.Fprintf(&b, "# HELP xrayapi_traffic_bytes_total Total traffic reported per user, by direction.\n")
+	fmt.Fprintf(&b, "# TYPE xrayapi_traffic_bytes_total counter\n")
+	emails := make([]string, 0, len(m.trafficUpload))
+	for email := range m.trafficUpload {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+	for _, email := range emails {
+		fmt.Fprintf(&b, "xrayapi_traffic_bytes_total{email=%q,direction=\"uplink\"} %d\n", email, m.trafficUpload[email])
+		fmt.Fprintf(&b, "xrayapi_traffic_bytes_total{email=%q,direction=\"downlink\"} %d\n", email, m.trafficDownload[email])
+	}
+
+	fmt.Fprintf(&b, "# HELP xrayapi_current_users Number of users currently provisioned.\n")
+	fmt.Fprintf(&b, "# TYPE xrayapi_current_users gauge\n")
+	fmt.Fprintf(&b, "xrayapi_current_users %d\n", m.currentUserCount)
+
+	fmt.Fprintf(&b, "# HELP xrayapi_last_cycle_duration_seconds Duration of the most recent sync cycle.\n")
+	fmt.Fprintf(&b, "# TYPE xrayapi_last_cycle_duration_seconds gauge\n")
+	fmt.Fprintf(&b, "xrayapi_last_cycle_duration_seconds %f\n", m.lastCycleDur.Seconds())
+
+	fmt.Fprintf(&b, "# HELP xrayapi_traffic_buffer_unflushed_bytes Traffic bytes buffered but not yet flushed to MySQL.\n")
+	fmt.Fprintf(&b, "# TYPE xrayapi_traffic_buffer_unflushed_bytes gauge\n")
+	fmt.Fprintf(&b, "xrayapi_traffic_buffer_unflushed_bytes %d\n", m.bufferedTraffic)
+
+	return b.String()
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/xtls/xray-core/app/proxyman/command"
+	statsService "github.com/xtls/xray-core/app/stats/command"
+)
+
+// Syncer owns every dependency a sync cycle needs and caches the
+// most-recently-synced user set in memory, so the admin API (GET /users,
+// POST /sync, DELETE /users/{email}) can inspect or drive the syncer
+// without re-reading the state store.
+type Syncer struct {
+	client      command.HandlerServiceClient
+	statsClient statsService.StatsServiceClient
+	store       StateStore
+	trafficBuf  *TrafficBuffer
+	configMgr   *ConfigManager
+	metrics     *Metrics
+
+	dbMu  sync.RWMutex
+	db    *sql.DB
+	dbDSN string
+
+	mu           sync.RWMutex
+	currentUsers []UserInfo
+}
+
+// NewSyncer wires a Syncer from its already-initialized dependencies. db
+// must already be open on cfg.MySQL's current DSN.
+func NewSyncer(db *sql.DB, cfg *MySQLConfig, xrayCtl *XrayController, store StateStore, trafficBuf *TrafficBuffer, configMgr *ConfigManager, metrics *Metrics) *Syncer {
+	return &Syncer{
+		db:          db,
+		dbDSN:       cfg.DSN(),
+		client:      xrayCtl.HsClient,
+		statsClient: xrayCtl.StatsClient,
+		store:       store,
+		trafficBuf:  trafficBuf,
+		configMgr:   configMgr,
+		metrics:     metrics,
+	}
+}
+
+// Close releases the syncer's current MySQL connection.
+func (s *Syncer) Close() error {
+	return s.currentDB().Close()
+}
+
+func (s *Syncer) currentDB() *sql.DB {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+	return s.db
+}
+
+// reloadDBIfChanged reopens the MySQL connection when mysql.* has changed
+// since the connection was last (re)opened, so a SIGHUP that rotates DB
+// credentials takes effect without restarting the process.
+func (s *Syncer) reloadDBIfChanged(cfg *Config) error {
+	dsn := cfg.MySQL.DSN()
+
+	s.dbMu.RLock()
+	changed := dsn != s.dbDSN
+	s.dbMu.RUnlock()
+	if !changed {
+		return nil
+	}
+
+	newDB, err := openMySQL(&cfg.MySQL)
+	if err != nil {
+		return fmt.Errorf("open mysql with reloaded credentials: %w", err)
+	}
+	if err := newDB.Ping(); err != nil {
+		newDB.Close()
+		return fmt.Errorf("ping mysql with reloaded credentials: %w", err)
+	}
+
+	s.dbMu.Lock()
+	oldDB := s.db
+	s.db = newDB
+	s.dbDSN = dsn
+	s.dbMu.Unlock()
+
+	oldDB.Close()
+	defaultLogger.Infof("数据库连接已使用新配置重新建立\n")
+	return nil
+}
+
+// RunCycle runs exactly one sync cycle: reconnect MySQL if its credentials
+// changed, load users from MySQL and the state store, reconcile them
+// against xray-core, and persist the result. It is shared by the
+// ticker-driven loop and the admin API's POST /sync.
+func (s *Syncer) RunCycle(ctx context.Context) error {
+	start := time.Now()
+	cfg := s.configMgr.Current()
+
+	if err := s.reloadDBIfChanged(cfg); err != nil {
+		defaultLogger.Errorf("数据库热重载失败，继续使用现有连接: %v\n", err)
+	}
+	db := s.currentDB()
+
+	dbUsers, err := getUsersFromDB(db, &cfg.Sync)
+	if err != nil {
+		s.metrics.RecordCycle(time.Since(start), s.userCount(), err)
+		return fmt.Errorf("get users from db: %w", err)
+	}
+
+	currentUsers, err := s.store.Load()
+	if err != nil {
+		s.metrics.RecordCycle(time.Since(start), s.userCount(), err)
+		return fmt.Errorf("load state: %w", err)
+	}
+
+	err = synchronizeUsers(ctx, s.client, s.statsClient, db, s.store, s.trafficBuf, s.metrics, dbUsers, currentUsers, &cfg.Sync)
+
+	synced, loadErr := s.store.Load()
+	if loadErr == nil {
+		s.mu.Lock()
+		s.currentUsers = synced
+		s.mu.Unlock()
+	}
+
+	s.metrics.RecordCycle(time.Since(start), len(synced), err)
+	return err
+}
+
+// Users returns a copy of the most-recently-synced user set.
+func (s *Syncer) Users() []UserInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]UserInfo, len(s.currentUsers))
+	copy(users, s.currentUsers)
+	return users
+}
+
+func (s *Syncer) userCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.currentUsers)
+}
+
+// ForceRemoveUser removes email from xray-core, disables it in MySQL, and
+// drops it from the state store, for operators who need to kick a user out
+// before the next regular cycle.
+func (s *Syncer) ForceRemoveUser(ctx context.Context, email string) error {
+	cfg := s.configMgr.Current()
+
+	s.mu.RLock()
+	var user *UserInfo
+	for i := range s.currentUsers {
+		if s.currentUsers[i].Email == email {
+			user = &s.currentUsers[i]
+			break
+		}
+	}
+	s.mu.RUnlock()
+	if user == nil {
+		return fmt.Errorf("user %q is not currently provisioned", email)
+	}
+
+	adapter, err := adapterForProtocol(user.Protocol, &cfg.Sync)
+	if err != nil {
+		return err
+	}
+
+	callCtx, cancel := callTimeout(ctx, callTimeoutFor(&cfg.Sync))
+	defer cancel()
+
+	if err := removeUser(callCtx, s.client, adapter, email); err != nil {
+		s.metrics.RecordUserRemove(false)
+		return fmt.Errorf("remove user from xray: %w", err)
+	}
+	s.metrics.RecordUserRemove(true)
+
+	if _, err := s.currentDB().Exec("UPDATE user SET enable = 0 WHERE port = ?", email); err != nil {
+		return fmt.Errorf("disable user in db: %w", err)
+	}
+
+	remaining := s.Users()
+	kept := remaining[:0]
+	for _, u := range remaining {
+		if u.Email != email {
+			kept = append(kept, u)
+		}
+	}
+	if err := s.store.Save(kept); err != nil {
+		return fmt.Errorf("save state: %w", err)
+	}
+
+	s.mu.Lock()
+	s.currentUsers = kept
+	s.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// StateStore persists the set of users the syncer believes are currently
+// provisioned on the local xray-core instance, replacing the
+// current_users.json snapshot so multiple syncer instances can share state
+// safely instead of each keeping its own file.
+type StateStore interface {
+	Load() ([]UserInfo, error)
+	Save(users []UserInfo) error
+}
+
+// NewStateStore builds the StateStore selected by cfg.Driver ("file" or
+// "redis"), defaulting to the file store to preserve the syncer's original
+// on-disk behavior.
+func NewStateStore(cfg *StateConfig, nodeID string) (StateStore, error) {
+	switch cfg.Driver {
+	case "", "file":
+		path := cfg.FilePath
+		if path == "" {
+			path = "current_users.json"
+		}
+		return &FileStateStore{Path: path}, nil
+	case "redis":
+		return NewRedisStateStore(cfg, nodeID)
+	default:
+		return nil, fmt.Errorf("state: unknown driver %q", cfg.Driver)
+	}
+}
+
+// FileStateStore is the original current_users.json-backed implementation,
+// kept for single-instance deployments that don't need Redis.
+type FileStateStore struct {
+	Path string
+}
+
+func (s *FileStateStore) Load() ([]UserInfo, error) {
+	return getCurrentSSUsers(s.Path)
+}
+
+func (s *FileStateStore) Save(users []UserInfo) error {
+	return saveCurrentSSUsers(s.Path, users)
+}
+
+// RedisStateStore stores each user as a hash under
+// "xray:node:<node_id>:user:<email>" and tracks membership in the set
+// "xray:node:<node_id>:users", so several syncer instances pointed at the
+// same Redis can coordinate without racing on a shared file.
+type RedisStateStore struct {
+	client *redis.Client
+	nodeID string
+}
+
+// NewRedisStateStore builds a RedisStateStore, picking the DB index by
+// hashing nodeID modulo cfg.Shardings when set, falling back to the `db`
+// segment of the DSN path otherwise.
+func NewRedisStateStore(cfg *StateConfig, nodeID string) (*RedisStateStore, error) {
+	opts, err := redis.ParseURL(cfg.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("state: parse redis dsn: %w", err)
+	}
+
+	if cfg.Shardings > 0 {
+		opts.DB = shardDB(nodeID, cfg.Shardings)
+	} else if opts.DB == 0 {
+		if db, ok := dbFromDSNPath(cfg.DSN); ok {
+			opts.DB = db
+		}
+	}
+
+	return &RedisStateStore{
+		client: redis.NewClient(opts),
+		nodeID: nodeID,
+	}, nil
+}
+
+func shardDB(nodeID string, shardings int) int {
+	h := fnv.New32a()
+	h.Write([]byte(nodeID))
+	return int(h.Sum32() % uint32(shardings))
+}
+
+func dbFromDSNPath(dsn string) (int, bool) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return 0, false
+	}
+	path := strings.TrimPrefix(u.Path, "/")
+	if path == "" {
+		return 0, false
+	}
+	db, err := strconv.Atoi(path)
+	if err != nil {
+		return 0, false
+	}
+	return db, true
+}
+
+func (s *RedisStateStore) usersSetKey() string {
+	return fmt.Sprintf("xray:node:%s:users", s.nodeID)
+}
+
+func (s *RedisStateStore) userKey(email string) string {
+	return fmt.Sprintf("xray:node:%s:user:%s", s.nodeID, email)
+}
+
+func (s *RedisStateStore) Load() ([]UserInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	emails, err := s.client.SMembers(ctx, s.usersSetKey()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("state: smembers %s: %w", s.usersSetKey(), err)
+	}
+
+	users := make([]UserInfo, 0, len(emails))
+	for _, email := range emails {
+		fields, err := s.client.HGetAll(ctx, s.userKey(email)).Result()
+		if err != nil {
+			return nil, fmt.Errorf("state: hgetall %s: %w", s.userKey(email), err)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		users = append(users, UserInfo{
+			Email:    email,
+			Password: fields["password"],
+			Protocol: fields["protocol"],
+		})
+	}
+
+	return users, nil
+}
+
+func (s *RedisStateStore) Save(users []UserInfo) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	existing, err := s.client.SMembers(ctx, s.usersSetKey()).Result()
+	if err != nil {
+		return fmt.Errorf("state: smembers %s: %w", s.usersSetKey(), err)
+	}
+
+	want := make(map[string]bool, len(users))
+	for _, user := range users {
+		want[user.Email] = true
+	}
+
+	pipe := s.client.TxPipeline()
+	now := time.Now().Format(time.RFC3339)
+	for _, user := range users {
+		pipe.HSet(ctx, s.userKey(user.Email), map[string]interface{}{
+			"password":   user.Password,
+			"protocol":   user.Protocol,
+			"updated_at": now,
+		})
+		pipe.SAdd(ctx, s.usersSetKey(), user.Email)
+	}
+	for _, email := range existing {
+		if !want[email] {
+			pipe.Del(ctx, s.userKey(email))
+			pipe.SRem(ctx, s.usersSetKey(), email)
+		}
+	}
+
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("state: save pipeline: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// syncError records the failure encountered while syncing a single user, so
+// a cycle's aggregated error can still point at which user caused it.
+type syncError struct {
+	Email string
+	Err   error
+}
+
+func (e *syncError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Email, e.Err)
+}
+
+// multiError aggregates the per-user errors from one sync cycle instead of
+// only logging them, so callers of synchronizeUsers can see exactly which
+// users failed.
+type multiError struct {
+	Errors []*syncError
+}
+
+func (m *multiError) Error() string {
+	parts := make([]string, len(m.Errors))
+	for i, e := range m.Errors {
+		parts[i] = e.Error()
+	}
+	return fmt.Sprintf("%d user(s) failed to sync: %s", len(m.Errors), strings.Join(parts, "; "))
+}
+
+// errCollector gathers syncErrors from concurrent workers behind a mutex.
+type errCollector struct {
+	mu   sync.Mutex
+	errs []*syncError
+}
+
+func (c *errCollector) add(email string, err error) {
+	if err == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errs = append(c.errs, &syncError{Email: email, Err: err})
+}
+
+func (c *errCollector) asError() error {
+	if len(c.errs) == 0 {
+		return nil
+	}
+	return &multiError{Errors: c.errs}
+}
+
+// callTimeout bounds a single AlterInbound/QueryStats RPC, modeled on
+// gonet's cancel-channel pattern: a timer derived from the cycle's parent
+// context closes the call's own context so one hung RPC cannot outlive the
+// cycle it belongs to.
+func callTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, timeout)
+}
+
+// rootContext returns a context cancelled either by the caller's cancel
+// func or by SIGTERM, so an operator-initiated shutdown aborts any in-flight
+// sync cycle instead of waiting for it to finish.
+func rootContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		defaultLogger.Infof("收到 SIGTERM，正在取消同步周期\n")
+		cancel()
+	}()
+
+	return ctx, cancel
+}
+
+// worker pool size and per-call timeout, applied when a SyncConfig doesn't
+// set them explicitly.
+const (
+	defaultWorkers     = 8
+	defaultCallTimeout = 10 * time.Second
+)
+
+func workerCount(cfg *SyncConfig) int {
+	if cfg.Workers > 0 {
+		return cfg.Workers
+	}
+	return defaultWorkers
+}
+
+func callTimeoutFor(cfg *SyncConfig) time.Duration {
+	if cfg.CallTimeout > 0 {
+		return cfg.CallTimeout
+	}
+	return defaultCallTimeout
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+const defaultTrafficBatchSize = 200
+
+// TrafficBuffer accumulates per-user traffic deltas in memory across sync
+// cycles and flushes them to MySQL in multi-row UPDATE statements, so a
+// temporarily unreachable database no longer means the traffic accounted
+// for during the outage is lost: updateTraffic used to issue one UPDATE per
+// user per cycle with reset=true on the stats query, which discarded the
+// counters for good the moment the UPDATE failed.
+type TrafficBuffer struct {
+	mu        sync.Mutex
+	deltas    map[string]TrafficData
+	spillPath string
+	batchSize int
+	metrics   *Metrics
+}
+
+// NewTrafficBuffer builds a TrafficBuffer from cfg, loading any deltas left
+// over from a previous run's spill file.
+func NewTrafficBuffer(cfg *TrafficConfig, metrics *Metrics) *TrafficBuffer {
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultTrafficBatchSize
+	}
+
+	b := &TrafficBuffer{
+		deltas:    make(map[string]TrafficData),
+		spillPath: cfg.SpillPath,
+		batchSize: batchSize,
+		metrics:   metrics,
+	}
+	b.loadSpill()
+	return b
+}
+
+// Add accumulates a traffic delta for email, to be written on the next Flush.
+func (b *TrafficBuffer) Add(email string, traffic TrafficData) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cur := b.deltas[email]
+	cur.Upload += traffic.Upload
+	cur.Download += traffic.Download
+	b.deltas[email] = cur
+
+	b.recordUnflushedLocked()
+}
+
+// Flush writes every buffered delta to MySQL in batchSize-sized multi-row
+// "UPDATE ... CASE" statements (see flushBatch). A delta only leaves the
+// buffer once its batch commits, so deltas accumulated by a failed batch
+// (or added concurrently while the flush is in flight) are included in the
+// next successful flush.
+func (b *TrafficBuffer) Flush(db *sql.DB) error {
+	b.mu.Lock()
+	pending := make(map[string]TrafficData, len(b.deltas))
+	for email, d := range b.deltas {
+		pending[email] = d
+	}
+	b.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	emails := make([]string, 0, len(pending))
+	for email := range pending {
+		emails = append(emails, email)
+	}
+
+	var flushErr error
+	for i := 0; i < len(emails); i += b.batchSize {
+		end := i + b.batchSize
+		if end > len(emails) {
+			end = len(emails)
+		}
+		batch := emails[i:end]
+		if err := b.flushBatch(db, batch, pending); err != nil {
+			flushErr = fmt.Errorf("flush traffic batch: %w", err)
+			continue
+		}
+		b.settle(batch, pending)
+	}
+
+	b.mu.Lock()
+	b.recordUnflushedLocked()
+	b.saveSpillLocked()
+	b.mu.Unlock()
+
+	return flushErr
+}
+
+// settle subtracts the flushed amount from each buffered delta, dropping it
+// once it reaches zero; any amount Added while the flush was in flight is
+// preserved.
+func (b *TrafficBuffer) settle(batch []string, flushed map[string]TrafficData) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, email := range batch {
+		cur, ok := b.deltas[email]
+		if !ok {
+			continue
+		}
+		f := flushed[email]
+		cur.Upload -= f.Upload
+		cur.Download -= f.Download
+		if cur.Upload <= 0 && cur.Download <= 0 {
+			delete(b.deltas, email)
+		} else {
+			b.deltas[email] = cur
+		}
+	}
+}
+
+// flushBatch updates each matched email's counters in a single multi-row
+// UPDATE ... CASE statement. Unlike the previous INSERT ... ON DUPLICATE KEY
+// UPDATE, this never creates a row: a user whose row was deleted (not just
+// disabled) between being buffered and flushed would otherwise get a
+// phantom row with no passwd/protocol/enable, either failing on a NOT NULL
+// column or silently re-provisioning a removed user. Deltas for ports that
+// no longer exist are logged and dropped instead.
+func (b *TrafficBuffer) flushBatch(db *sql.DB, emails []string, pending map[string]TrafficData) error {
+	existing, err := existingPorts(db, emails)
+	if err != nil {
+		return fmt.Errorf("check existing ports: %w", err)
+	}
+
+	matched, missing := partitionPorts(emails, existing)
+	if len(missing) > 0 {
+		defaultLogger.Warnf("dropping buffered traffic for %d user(s) no longer in the database: %s\n", len(missing), strings.Join(missing, ", "))
+		b.settle(missing, pending)
+	}
+	if len(matched) == 0 {
+		return nil
+	}
+
+	query, args := buildTrafficUpdateQuery(matched, pending)
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+
+	// A row can still be deleted between the SELECT above and this UPDATE;
+	// when that happens the UPDATE silently affects fewer rows than
+	// matched, so settle() (called by Flush for the whole batch) would
+	// otherwise drop that row's traffic with no record of why.
+	if affected, err := result.RowsAffected(); err == nil && int(affected) < len(matched) {
+		defaultLogger.Warnf("traffic update affected %d row(s), expected %d — some buffered traffic may have been dropped for users deleted mid-flush\n", affected, len(matched))
+	}
+	return nil
+}
+
+// existingPorts queries which of emails (port numbers as strings) still
+// have a row in user, returning it as a set suitable for partitionPorts.
+func existingPorts(db *sql.DB, emails []string) (map[string]bool, error) {
+	placeholders := make([]string, len(emails))
+	args := make([]interface{}, len(emails))
+	for i, email := range emails {
+		placeholders[i] = "?"
+		args[i] = email
+	}
+
+	rows, err := db.Query(fmt.Sprintf("SELECT port FROM user WHERE port IN (%s)", strings.Join(placeholders, ", ")), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exists := make(map[string]bool, len(emails))
+	for rows.Next() {
+		var port string
+		if err := rows.Scan(&port); err != nil {
+			return nil, err
+		}
+		exists[port] = true
+	}
+	return exists, rows.Err()
+}
+
+// partitionPorts splits emails into those present in existing and those
+// that aren't, preserving input order in both.
+func partitionPorts(emails []string, existing map[string]bool) (matched, missing []string) {
+	for _, email := range emails {
+		if existing[email] {
+			matched = append(matched, email)
+		} else {
+			missing = append(missing, email)
+		}
+	}
+	return matched, missing
+}
+
+// buildTrafficUpdateQuery builds the multi-row "UPDATE user SET u = CASE
+// port ... END, d = CASE port ... END WHERE port IN (...)" statement that
+// applies every matched email's delta in a single round trip without
+// inserting a row for a port that isn't already there.
+func buildTrafficUpdateQuery(matched []string, pending map[string]TrafficData) (string, []interface{}) {
+	uCases := make([]string, 0, len(matched))
+	dCases := make([]string, 0, len(matched))
+	placeholders := make([]string, 0, len(matched))
+	var uArgs, dArgs, whereArgs []interface{}
+	for _, email := range matched {
+		d := pending[email]
+		uCases = append(uCases, "WHEN ? THEN u + ?")
+		dCases = append(dCases, "WHEN ? THEN d + ?")
+		placeholders = append(placeholders, "?")
+		uArgs = append(uArgs, email, d.Upload)
+		dArgs = append(dArgs, email, d.Download)
+		whereArgs = append(whereArgs, email)
+	}
+
+	query := fmt.Sprintf(
+		"UPDATE user SET u = CASE port %s ELSE u END, d = CASE port %s ELSE d END WHERE port IN (%s)",
+		strings.Join(uCases, " "),
+		strings.Join(dCases, " "),
+		strings.Join(placeholders, ", "),
+	)
+	args := append(append(uArgs, dArgs...), whereArgs...)
+	return query, args
+}
+
+// recordUnflushedLocked pushes the current buffered-but-unflushed byte
+// total into metrics; the caller must hold b.mu.
+func (b *TrafficBuffer) recordUnflushedLocked() {
+	var bytes int64
+	for _, d := range b.deltas {
+		bytes += d.Upload + d.Download
+	}
+	b.metrics.SetBufferedTrafficBytes(bytes)
+}
+
+func (b *TrafficBuffer) loadSpill() {
+	if b.spillPath == "" {
+		return
+	}
+	raw, err := ioutil.ReadFile(b.spillPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			defaultLogger.Errorf("Failed to load traffic spill file %s: %v\n", b.spillPath, err)
+		}
+		return
+	}
+
+	var deltas map[string]TrafficData
+	if err := json.Unmarshal(raw, &deltas); err != nil {
+		defaultLogger.Errorf("Failed to parse traffic spill file %s: %v\n", b.spillPath, err)
+		return
+	}
+
+	b.mu.Lock()
+	b.deltas = deltas
+	b.recordUnflushedLocked()
+	b.mu.Unlock()
+}
+
+// saveSpillLocked persists the current buffer to disk; the caller must hold b.mu.
+func (b *TrafficBuffer) saveSpillLocked() {
+	if b.spillPath == "" {
+		return
+	}
+	raw, err := json.Marshal(b.deltas)
+	if err != nil {
+		defaultLogger.Errorf("Failed to marshal traffic spill file %s: %v\n", b.spillPath, err)
+		return
+	}
+	if err := ioutil.WriteFile(b.spillPath, raw, 0644); err != nil {
+		defaultLogger.Errorf("Failed to write traffic spill file %s: %v\n", b.spillPath, err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func newTestTrafficBuffer() *TrafficBuffer {
+	return NewTrafficBuffer(&TrafficConfig{}, NewMetrics())
+}
+
+func TestTrafficBufferAddAccumulates(t *testing.T) {
+	b := newTestTrafficBuffer()
+
+	b.Add("a@example.com", TrafficData{Upload: 10, Download: 20})
+	b.Add("a@example.com", TrafficData{Upload: 5, Download: 0})
+
+	got := b.deltas["a@example.com"]
+	want := TrafficData{Upload: 15, Download: 20}
+	if got != want {
+		t.Errorf("deltas[a] = %+v, want %+v", got, want)
+	}
+}
+
+func TestTrafficBufferSettlePartial(t *testing.T) {
+	b := newTestTrafficBuffer()
+	b.Add("a@example.com", TrafficData{Upload: 10, Download: 20})
+
+	// Simulate more traffic arriving while a flush of the original amount
+	// is in flight, then settling only the flushed amount.
+	flushed := map[string]TrafficData{"a@example.com": {Upload: 10, Download: 20}}
+	b.Add("a@example.com", TrafficData{Upload: 3, Download: 0})
+	b.settle([]string{"a@example.com"}, flushed)
+
+	got := b.deltas["a@example.com"]
+	want := TrafficData{Upload: 3, Download: 0}
+	if got != want {
+		t.Errorf("deltas[a] after settle = %+v, want %+v", got, want)
+	}
+}
+
+func TestTrafficBufferSettleDropsWhenZero(t *testing.T) {
+	b := newTestTrafficBuffer()
+	b.Add("a@example.com", TrafficData{Upload: 10, Download: 20})
+
+	flushed := map[string]TrafficData{"a@example.com": {Upload: 10, Download: 20}}
+	b.settle([]string{"a@example.com"}, flushed)
+
+	if _, ok := b.deltas["a@example.com"]; ok {
+		t.Error("deltas[a] should be removed once fully settled")
+	}
+}
+
+func TestPartitionPorts(t *testing.T) {
+	existing := map[string]bool{"80": true, "81": true}
+	matched, missing := partitionPorts([]string{"80", "81", "82"}, existing)
+
+	if got, want := strings.Join(matched, ","), "80,81"; got != want {
+		t.Errorf("matched = %q, want %q", got, want)
+	}
+	if got, want := strings.Join(missing, ","), "82"; got != want {
+		t.Errorf("missing = %q, want %q", got, want)
+	}
+}
+
+func TestPartitionPortsAllMissing(t *testing.T) {
+	matched, missing := partitionPorts([]string{"80"}, map[string]bool{})
+	if len(matched) != 0 {
+		t.Errorf("matched = %v, want empty", matched)
+	}
+	if len(missing) != 1 || missing[0] != "80" {
+		t.Errorf("missing = %v, want [80]", missing)
+	}
+}
+
+func TestBuildTrafficUpdateQuery(t *testing.T) {
+	pending := map[string]TrafficData{
+		"80": {Upload: 10, Download: 20},
+		"81": {Upload: 30, Download: 40},
+	}
+
+	query, args := buildTrafficUpdateQuery([]string{"80", "81"}, pending)
+
+	if !strings.Contains(query, "UPDATE user SET u = CASE port") {
+		t.Errorf("query = %q, want an UPDATE ... CASE port statement", query)
+	}
+	if strings.Contains(query, "INSERT") {
+		t.Errorf("query = %q, must never INSERT a new row", query)
+	}
+
+	want := []interface{}{
+		"80", int64(10), "81", int64(30),
+		"80", int64(20), "81", int64(40),
+		"80", "81",
+	}
+	if len(args) != len(want) {
+		t.Fatalf("args = %v (len %d), want len %d", args, len(args), len(want))
+	}
+	for i := range want {
+		if args[i] != want[i] {
+			t.Errorf("args[%d] = %v, want %v", i, args[i], want[i])
+		}
+	}
+}